@@ -23,28 +23,85 @@ package cmd
 
 import (
 	"archive/zip"
-	"bytes"
-	"compress/gzip"
-	"encoding/gob"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"reflect"
+	"runtime"
 	"strings"
+	"sync"
 	"text/tabwriter"
 
 	"github.com/apex/log"
 	"github.com/blacktop/go-macho"
-	"github.com/blacktop/go-plist"
 	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/blacktop/ipsw/pkg/ent"
+	entdb "github.com/blacktop/ipsw/pkg/ent/db"
+	"github.com/blacktop/ipsw/pkg/ent/fswalk"
 	"github.com/blacktop/ipsw/pkg/info"
+	"github.com/schollz/progressbar/v3"
+	"github.com/spf13/afero"
 	"github.com/spf13/cobra"
 )
 
-type Entitlements map[string]interface{}
+// legacyDBExt is the file extension used by the old gzipped-gob entitlement
+// database, kept around only to detect and auto-migrate it.
+const legacyDBExt = ".entDB"
+
+// dbExt is the directory extension for the content-addressable entitlement
+// database (a manifest.json plus a blobs/ pack). It deliberately doesn't
+// differ from legacyDBExt only by case: on the case-insensitive
+// filesystems this tool mainly runs on (macOS, Windows), "foo.entDB" and
+// "foo.entdb" name the same path, and entdb.Open would try to read
+// manifest.json out of what the OS resolves to the legacy gob file.
+const dbExt = ".entitlementsdb"
+
+// haveCheckedMu guards haveChecked, which scanEnts's parallel workers never
+// touch directly but which every call to scanEnts itself reads and appends
+// to.
+var haveCheckedMu sync.Mutex
+
+// machoEntitlements extracts the raw entitlements plist (or "" for none)
+// from an already-opened MachO. It's the fswalk.Extractor used by scanEnts.
+func machoEntitlements(f afero.File) (string, error) {
+	m, err := macho.NewFile(f)
+	if err != nil {
+		return "", err
+	}
+	defer m.Close()
+	if m.CodeSignature() != nil {
+		return m.CodeSignature().Entitlements, nil
+	}
+	return "", nil
+}
 
-func scanEnts(ipswPath, dmgPath, dmgType string) (map[string]string, error) {
-	if utils.StrSliceHas(haveChecked, dmgPath) {
+// fileDigest returns the hex-encoded sha256 of path's contents.
+func fileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// scanEnts opens dmgPath (extracted from ipswPath) with backend and scans
+// every MachO it contains for entitlements using jobs concurrent workers.
+// If edb is non-nil and already holds entries scanned from an identical
+// copy of this DMG (same sha256, recorded via edb.SetSourceDigest), the
+// scan is skipped entirely.
+func scanEnts(ipswPath, dmgPath, dmgType string, backend fswalk.Backend, jobs int, edb *entdb.DB) (map[string]string, error) {
+	haveCheckedMu.Lock()
+	skip := utils.StrSliceHas(haveChecked, dmgPath)
+	haveCheckedMu.Unlock()
+	if skip {
 		return nil, nil // already checked
 	}
 
@@ -59,41 +116,93 @@ func scanEnts(ipswPath, dmgPath, dmgType string) (map[string]string, error) {
 	}
 	defer os.Remove(dmgs[0])
 
-	utils.Indent(log.Info, 3)(fmt.Sprintf("Mounting %s %s", dmgType, dmgs[0]))
-	mountPoint, err := utils.MountFS(dmgs[0])
+	digest, err := fileDigest(dmgs[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to digest %s: %v", dmgs[0], err)
+	}
+	if edb != nil {
+		if prev, ok := edb.SourceDigest(dmgType); ok && prev == digest {
+			utils.Indent(log.Info, 3)(fmt.Sprintf("%s unchanged since last scan, skipping", dmgType))
+			haveCheckedMu.Lock()
+			haveChecked = append(haveChecked, dmgPath)
+			haveCheckedMu.Unlock()
+			return nil, nil
+		}
+	}
+
+	utils.Indent(log.Info, 3)(fmt.Sprintf("Opening %s %s", dmgType, dmgs[0]))
+	fsys, cleanup, err := backend(dmgs[0])
 	if err != nil {
-		return nil, fmt.Errorf("failed to mount DMG: %v", err)
+		return nil, fmt.Errorf("failed to open DMG: %v", err)
 	}
 	defer func() {
-		utils.Indent(log.Info, 3)(fmt.Sprintf("Unmounting %s", dmgs[0]))
-		if err := utils.Unmount(mountPoint, false); err != nil {
-			log.Errorf("failed to unmount DMG at %s: %v", dmgs[0], err)
+		if err := cleanup(); err != nil {
+			log.Errorf("failed to release %s: %v", dmgs[0], err)
 		}
 	}()
 
-	var files []string
-	if err := filepath.Walk(mountPoint, func(path string, info os.FileInfo, err error) error {
-		if !info.IsDir() {
-			files = append(files, path)
-		}
+	var total int
+	if err := fswalk.Walk(fsys, "/", func(string) error {
+		total++
 		return nil
 	}); err != nil {
-		return nil, fmt.Errorf("failed to walk files in dir %s: %v", mountPoint, err)
+		return nil, fmt.Errorf("failed to count files in %s: %v", dmgPath, err)
 	}
 
-	entDB := make(map[string]string)
+	pb := progressbar.Default(int64(total), fmt.Sprintf("Scanning %s", dmgType))
+	entDB, err := fswalk.ScanParallel(context.Background(), fsys, "/", jobs, machoEntitlements, func() {
+		pb.Add(1)
+	})
+	pb.Finish()
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk files in %s: %v", dmgPath, err)
+	}
 
-	for _, file := range files {
-		if m, err := macho.Open(file); err == nil {
-			if m.CodeSignature() != nil && len(m.CodeSignature().Entitlements) > 0 {
-				entDB[strings.TrimPrefix(file, mountPoint)] = m.CodeSignature().Entitlements
-			} else {
-				entDB[strings.TrimPrefix(file, mountPoint)] = ""
-			}
-		}
+	if edb != nil {
+		edb.SetSourceDigest(dmgType, digest)
 	}
 
+	haveCheckedMu.Lock()
 	haveChecked = append(haveChecked, dmgPath)
+	haveCheckedMu.Unlock()
+
+	return entDB, nil
+}
+
+// scanAllEnts scans every filesystem DMG (AppOS, SystemOS, filesystem) in an
+// IPSW and returns a single path -> raw entitlements plist map. edb may be
+// nil for a one-off scan with no unchanged-DMG caching (e.g. `ent diff`
+// against a raw IPSW).
+func scanAllEnts(i *info.Info, ipswPath string, backend fswalk.Backend, jobs int, edb *entdb.DB) (map[string]string, error) {
+	entDB := make(map[string]string)
+
+	if appOS, err := i.GetAppOsDmg(); err == nil {
+		ents, err := scanEnts(ipswPath, appOS, "AppOS", backend, jobs, edb)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan files in AppOS %s: %v", appOS, err)
+		}
+		for path, plist := range ents {
+			entDB[path] = plist
+		}
+	}
+	if systemOS, err := i.GetSystemOsDmg(); err == nil {
+		ents, err := scanEnts(ipswPath, systemOS, "SystemOS", backend, jobs, edb)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan files in SystemOS %s: %v", systemOS, err)
+		}
+		for path, plist := range ents {
+			entDB[path] = plist
+		}
+	}
+	if fsOS, err := i.GetFileSystemOsDmg(); err == nil {
+		ents, err := scanEnts(ipswPath, fsOS, "filesystem", backend, jobs, edb)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan files in filesystem %s: %v", fsOS, err)
+		}
+		for path, plist := range ents {
+			entDB[path] = plist
+		}
+	}
 
 	return entDB, nil
 }
@@ -103,7 +212,25 @@ func init() {
 
 	entCmd.Flags().StringP("ent", "e", "", "Entitlement to search for")
 	entCmd.Flags().String("db", "", "Path to entitlement database to use")
-	entCmd.Flags().StringP("file", "f", "", "Output entitlements for file")
+	entCmd.Flags().String("merge", "", "Merge another entitlement database into --db before searching")
+	entCmd.Flags().StringP("file", "f", "", "Output entitlements for file (case-insensitive substring match, or glob if it contains *, ? or [)")
+	entCmd.Flags().StringP("query", "q", "", "Entitlement query expression (e.g. 'com.apple.private.security.storage.*==allow')")
+	entCmd.Flags().IntP("jobs", "j", runtime.NumCPU(), "Number of concurrent MachO scanning workers")
+}
+
+// matchFile reports whether path matches a --file pattern: a glob (via
+// filepath.Match, against the full path or just its base name) if pattern
+// contains any glob metacharacters, otherwise a case-insensitive substring
+// match anywhere in path.
+func matchFile(pattern, path string) bool {
+	if strings.ContainsAny(pattern, "*?[") {
+		if ok, err := filepath.Match(pattern, path); err == nil && ok {
+			return true
+		}
+		ok, err := filepath.Match(pattern, filepath.Base(path))
+		return err == nil && ok
+	}
+	return strings.Contains(strings.ToLower(path), strings.ToLower(pattern))
 }
 
 // entCmd represents the ent command
@@ -119,140 +246,133 @@ var entCmd = &cobra.Command{
 		}
 
 		entitlement, _ := cmd.Flags().GetString("ent")
-		entDBPath, _ := cmd.Flags().GetString("db")
+		dbPath, _ := cmd.Flags().GetString("db")
+		mergePath, _ := cmd.Flags().GetString("merge")
 		searchFile, _ := cmd.Flags().GetString("file")
+		queryStr, _ := cmd.Flags().GetString("query")
+		jobs, _ := cmd.Flags().GetInt("jobs")
 
-		if len(entitlement) == 0 && len(searchFile) == 0 {
-			log.Errorf("you must supply a --ent OR --file")
+		backend := fswalk.Mounted
+
+		selected := 0
+		for _, s := range []string{entitlement, searchFile, queryStr} {
+			if len(s) > 0 {
+				selected++
+			}
+		}
+		if selected == 0 {
+			log.Errorf("you must supply a --ent, --file OR --query")
 			return nil
-		} else if len(entitlement) > 0 && len(searchFile) > 0 {
-			log.Errorf("you can only use --ent OR --file (not both)")
+		} else if selected > 1 {
+			log.Errorf("you can only use one of --ent, --file OR --query")
 			return nil
 		}
 
+		var query *ent.Query
+		if len(queryStr) > 0 {
+			var err error
+			if query, err = ent.ParseQuery(queryStr); err != nil {
+				return fmt.Errorf("invalid --query expression: %v", err)
+			}
+		}
+
 		ipswPath := filepath.Clean(args[0])
 
-		if len(entDBPath) == 0 {
-			entDBPath = strings.TrimSuffix(ipswPath, filepath.Ext(ipswPath)) + ".entDB"
+		if len(dbPath) == 0 {
+			dbPath = strings.TrimSuffix(ipswPath, filepath.Ext(ipswPath)) + dbExt
 		}
+		legacyPath := strings.TrimSuffix(ipswPath, filepath.Ext(ipswPath)) + legacyDBExt
 
 		i, err := info.Parse(ipswPath)
 		if err != nil {
 			return fmt.Errorf("failed to parse IPSW: %v", err)
 		}
 
-		entDB := make(map[string]string)
-
-		if _, err := os.Stat(entDBPath); os.IsNotExist(err) {
-			log.Info("Generating entitlement database file...")
+		edb, err := entdb.Open(dbPath)
+		if err != nil {
+			return fmt.Errorf("failed to open entitlement database %s: %v", dbPath, err)
+		}
 
-			if appOS, err := i.GetAppOsDmg(); err == nil {
-				if ents, err := scanEnts(ipswPath, appOS, "AppOS"); err != nil {
-					return fmt.Errorf("failed to scan files in AppOS %s: %v", appOS, err)
-				} else {
-					for k, v := range ents {
-						entDB[k] = v
-					}
+		if edb.Len() == 0 {
+			if _, err := os.Stat(legacyPath); err == nil {
+				log.Infof("Migrating legacy entitlement database %s...", legacyPath)
+				if err := entdb.MigrateGob(edb, legacyPath); err != nil {
+					return fmt.Errorf("failed to migrate legacy entitlement database: %v", err)
 				}
 			}
-			if systemOS, err := i.GetSystemOsDmg(); err == nil {
-				if ents, err := scanEnts(ipswPath, systemOS, "SystemOS"); err != nil {
-					return fmt.Errorf("failed to scan files in SystemOS %s: %v", systemOS, err)
-				} else {
-					for k, v := range ents {
-						entDB[k] = v
-					}
-				}
-			}
-			if fsOS, err := i.GetFileSystemOsDmg(); err == nil {
-				if ents, err := scanEnts(ipswPath, fsOS, "filesystem"); err != nil {
-					return fmt.Errorf("failed to scan files in filesystem %s: %v", fsOS, err)
-				} else {
-					for k, v := range ents {
-						entDB[k] = v
-					}
-				}
-			}
-
-			buff := new(bytes.Buffer)
-
-			e := gob.NewEncoder(buff)
-
-			// Encoding the map
-			err := e.Encode(entDB)
-			if err != nil {
-				return fmt.Errorf("failed to encode entitlement db to binary: %v", err)
-			}
+		}
 
-			of, err := os.Create(entDBPath)
+		if len(mergePath) > 0 {
+			other, err := entdb.Open(mergePath)
 			if err != nil {
-				return fmt.Errorf("failed to create file %s: %v", ipswPath+".entDB", err)
+				return fmt.Errorf("failed to open entitlement database to merge %s: %v", mergePath, err)
 			}
-			defer of.Close()
-
-			gzw := gzip.NewWriter(of)
-			defer gzw.Close()
-
-			_, err = buff.WriteTo(gzw)
-			if err != nil {
-				return fmt.Errorf("failed to write entitlement db to gzip file: %v", err)
-			}
-		} else {
-			log.Info("Found ipsw entitlement database file...")
-
-			edbFile, err := os.Open(entDBPath)
-			if err != nil {
-				return fmt.Errorf("failed to open entitlement database file %s; %v", entDBPath, err)
+			log.Infof("Merging %s into %s...", mergePath, dbPath)
+			if err := edb.Merge(other); err != nil {
+				return fmt.Errorf("failed to merge entitlement database: %v", err)
 			}
+		}
 
-			gzr, err := gzip.NewReader(edbFile)
-			if err != nil {
-				return fmt.Errorf("failed to create gzip reader: %v", err)
+		// scanAllEnts checks each DMG's digest against edb before scanning
+		// it, so an already-populated DB whose source DMGs are unchanged
+		// costs an extract-and-hash rather than a full re-scan.
+		log.Info("Scanning entitlement database...")
+		ents, err := scanAllEnts(i, ipswPath, backend, jobs, edb)
+		if err != nil {
+			return err
+		}
+		for path, plist := range ents {
+			if err := edb.Put(path, []byte(plist)); err != nil {
+				return fmt.Errorf("failed to store entitlements for %s: %v", path, err)
 			}
-
-			// Decoding the serialized data
-			err = gob.NewDecoder(gzr).Decode(&entDB)
-			if err != nil {
-				return fmt.Errorf("failed to decode entitlement database; %v", err)
+		}
+		if len(ents) > 0 || len(mergePath) > 0 {
+			if err := edb.Save(); err != nil {
+				return fmt.Errorf("failed to save entitlement database: %v", err)
 			}
-			gzr.Close()
-			edbFile.Close()
 		}
 
-		if len(searchFile) > 0 {
-			for f, ent := range entDB {
-				if strings.Contains(strings.ToLower(f), strings.ToLower(searchFile)) {
-					log.Infof(f)
-					if len(ent) > 0 {
-						fmt.Printf("\n%s\n", ent)
-					} else {
-						fmt.Printf("\n\t- no entitlements\n")
-					}
+		switch {
+		case len(searchFile) > 0:
+			return edb.WalkPrefix("/", func(f string, plist []byte) bool {
+				if !matchFile(searchFile, f) {
+					return true
+				}
+				log.Infof(f)
+				if len(plist) > 0 {
+					fmt.Printf("\n%s\n", plist)
+				} else {
+					fmt.Printf("\n\t- no entitlements\n")
 				}
+				return true
+			})
+		case query != nil:
+			log.Infof("Files matching query: %s", queryStr)
+			fmt.Println()
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
+			if err := edb.WalkPrefix("/", func(f string, plist []byte) bool {
+				if err := ent.FprintQuery(w, f, string(plist), query); err != nil {
+					log.Error(err.Error())
+				}
+				return true
+			}); err != nil {
+				return err
 			}
-		} else {
+			w.Flush()
+		default:
 			log.Infof("Files containing entitlement: %s", entitlement)
 			fmt.Println()
 			w := tabwriter.NewWriter(os.Stdout, 0, 0, 1, ' ', 0)
-			for f, ent := range entDB {
-				if strings.Contains(ent, entitlement) {
-					ents := Entitlements{}
-					if err := plist.NewDecoder(bytes.NewReader([]byte(ent))).Decode(&ents); err != nil {
-						return fmt.Errorf("failed to decode entitlements plist for %s: %v", f, err)
-					}
-					for k, v := range ents {
-						if strings.Contains(k, entitlement) {
-							switch v := reflect.ValueOf(v); v.Kind() {
-							case reflect.Bool:
-								if v.Bool() {
-									fmt.Fprintf(w, "%s\t%s\n", k, f)
-								}
-							default:
-								log.Error(fmt.Sprintf("unhandled entitlement kind %s in %s", f, v.Kind()))
-							}
-						}
-					}
+			if err := edb.WalkPrefix("/", func(f string, plist []byte) bool {
+				if !strings.Contains(string(plist), entitlement) {
+					return true
+				}
+				if err := ent.Fscan(w, f, string(plist), entitlement); err != nil {
+					log.Error(err.Error())
 				}
+				return true
+			}); err != nil {
+				return err
 			}
 			w.Flush()
 		}
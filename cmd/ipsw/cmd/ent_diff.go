@@ -0,0 +1,305 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+
+	"github.com/apex/log"
+	"github.com/blacktop/ipsw/pkg/ent"
+	entdb "github.com/blacktop/ipsw/pkg/ent/db"
+	"github.com/blacktop/ipsw/pkg/ent/fswalk"
+	"github.com/blacktop/ipsw/pkg/info"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	entCmd.AddCommand(entDiffCmd)
+
+	entDiffCmd.Flags().Bool("only-added", false, "Only show added binaries/entitlements (and changed values)")
+	entDiffCmd.Flags().Bool("only-removed", false, "Only show removed binaries/entitlements (and changed values)")
+	entDiffCmd.Flags().Bool("keys-only", false, "Only diff entitlement keys (ignore value changes)")
+	entDiffCmd.Flags().Bool("json", false, "Output diff as JSON")
+}
+
+// ValueChange describes a single entitlement key whose value differs
+// between the old and new binary.
+type ValueChange struct {
+	Old interface{} `json:"old"`
+	New interface{} `json:"new"`
+}
+
+// BinaryDiff describes how one binary's entitlements changed between the
+// old and new entitlement sets.
+type BinaryDiff struct {
+	Path    string                 `json:"path"`
+	Added   []string               `json:"added,omitempty"`
+	Removed []string               `json:"removed,omitempty"`
+	Changed map[string]ValueChange `json:"changed,omitempty"`
+}
+
+// EntDiff is the full result of comparing two entitlement sets.
+type EntDiff struct {
+	AddedBinaries   []string      `json:"added_binaries,omitempty"`
+	RemovedBinaries []string      `json:"removed_binaries,omitempty"`
+	Changed         []*BinaryDiff `json:"changed,omitempty"`
+}
+
+// entDiffCmd represents the ent diff command
+var entDiffCmd = &cobra.Command{
+	Use:          "diff <IPSW|entDB> <IPSW|entDB>",
+	Short:        "Diff MachO entitlements between two IPSWs (or entitlement databases)",
+	Args:         cobra.ExactArgs(2),
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+
+		if Verbose {
+			log.SetLevel(log.DebugLevel)
+		}
+
+		onlyAdded, _ := cmd.Flags().GetBool("only-added")
+		onlyRemoved, _ := cmd.Flags().GetBool("only-removed")
+		keysOnly, _ := cmd.Flags().GetBool("keys-only")
+		asJSON, _ := cmd.Flags().GetBool("json")
+
+		if onlyAdded && onlyRemoved {
+			log.Errorf("you can only use --only-added OR --only-removed (not both)")
+			return nil
+		}
+
+		if filepath.Ext(args[0]) == dbExt && filepath.Ext(args[1]) == dbExt {
+			same, err := sameEntDB(args[0], args[1])
+			if err != nil {
+				return err
+			}
+			if same {
+				log.Info("Entitlement databases are identical, nothing to diff")
+				return nil
+			}
+		}
+
+		oldEnts, err := loadEntsForDiff(args[0])
+		if err != nil {
+			return fmt.Errorf("failed to load entitlements for %s: %v", args[0], err)
+		}
+		newEnts, err := loadEntsForDiff(args[1])
+		if err != nil {
+			return fmt.Errorf("failed to load entitlements for %s: %v", args[1], err)
+		}
+
+		diff, err := diffEnts(oldEnts, newEnts, keysOnly)
+		if err != nil {
+			return err
+		}
+
+		if onlyAdded {
+			diff.RemovedBinaries = nil
+			for _, bd := range diff.Changed {
+				bd.Removed = nil
+			}
+		}
+		if onlyRemoved {
+			diff.AddedBinaries = nil
+			for _, bd := range diff.Changed {
+				bd.Added = nil
+			}
+		}
+		if onlyAdded || onlyRemoved {
+			diff.Changed = filterEmptyBinaryDiffs(diff.Changed)
+		}
+
+		if asJSON {
+			out, err := json.MarshalIndent(diff, "", "  ")
+			if err != nil {
+				return fmt.Errorf("failed to marshal diff: %v", err)
+			}
+			fmt.Println(string(out))
+			return nil
+		}
+
+		printEntDiff(diff)
+
+		return nil
+	},
+}
+
+// sameEntDB reports whether the content-addressable entitlement databases
+// at oldPath and newPath hold identical entries, using their manifest
+// digest instead of decoding every plist to compare.
+func sameEntDB(oldPath, newPath string) (bool, error) {
+	oldDB, err := entdb.Open(oldPath)
+	if err != nil {
+		return false, err
+	}
+	newDB, err := entdb.Open(newPath)
+	if err != nil {
+		return false, err
+	}
+	return oldDB.Digest() != "" && oldDB.Digest() == newDB.Digest(), nil
+}
+
+// loadEntsForDiff returns the path -> raw entitlements plist map for path,
+// which may be an IPSW, a content-addressable entDB directory, or a legacy
+// gzipped-gob .entDB file.
+func loadEntsForDiff(path string) (map[string]string, error) {
+	switch {
+	case filepath.Ext(path) == dbExt:
+		edb, err := entdb.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		ents := make(map[string]string)
+		if err := edb.WalkPrefix("/", func(f string, plist []byte) bool {
+			ents[f] = string(plist)
+			return true
+		}); err != nil {
+			return nil, err
+		}
+		return ents, nil
+	case filepath.Ext(path) == legacyDBExt:
+		// Diffing is read-only, so decode the legacy blob straight into a
+		// map instead of going through MigrateGob, which would persist a
+		// new on-disk store as a side effect of a comparison.
+		return entdb.DecodeGob(path)
+	default:
+		ipswPath := filepath.Clean(path)
+		if _, err := os.Stat(ipswPath); err != nil {
+			return nil, err
+		}
+		i, err := info.Parse(ipswPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse IPSW: %v", err)
+		}
+		return scanAllEnts(i, ipswPath, fswalk.Mounted, runtime.NumCPU(), nil)
+	}
+}
+
+// diffEnts decodes every binary's entitlements plist and computes the set
+// of added/removed binaries and, for binaries present in both, added,
+// removed and changed entitlement keys.
+func diffEnts(oldEnts, newEnts map[string]string, keysOnly bool) (*EntDiff, error) {
+	diff := &EntDiff{}
+
+	for path := range newEnts {
+		if _, ok := oldEnts[path]; !ok {
+			diff.AddedBinaries = append(diff.AddedBinaries, path)
+		}
+	}
+	for path := range oldEnts {
+		if _, ok := newEnts[path]; !ok {
+			diff.RemovedBinaries = append(diff.RemovedBinaries, path)
+		}
+	}
+	sort.Strings(diff.AddedBinaries)
+	sort.Strings(diff.RemovedBinaries)
+
+	for path, newPlist := range newEnts {
+		oldPlist, ok := oldEnts[path]
+		if !ok || oldPlist == newPlist {
+			continue
+		}
+
+		oldE, err := ent.Decode(oldPlist)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode old entitlements for %s: %v", path, err)
+		}
+		newE, err := ent.Decode(newPlist)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode new entitlements for %s: %v", path, err)
+		}
+
+		bd := &BinaryDiff{Path: path, Changed: make(map[string]ValueChange)}
+
+		for k, v := range newE {
+			old, ok := oldE[k]
+			if !ok {
+				bd.Added = append(bd.Added, k)
+			} else if !keysOnly && !reflect.DeepEqual(old, v) {
+				bd.Changed[k] = ValueChange{Old: old, New: v}
+			}
+		}
+		for k := range oldE {
+			if _, ok := newE[k]; !ok {
+				bd.Removed = append(bd.Removed, k)
+			}
+		}
+		sort.Strings(bd.Added)
+		sort.Strings(bd.Removed)
+
+		if len(bd.Added) > 0 || len(bd.Removed) > 0 || len(bd.Changed) > 0 {
+			diff.Changed = append(diff.Changed, bd)
+		}
+	}
+	sort.Slice(diff.Changed, func(i, j int) bool { return diff.Changed[i].Path < diff.Changed[j].Path })
+
+	return diff, nil
+}
+
+func printEntDiff(diff *EntDiff) {
+	for _, path := range diff.AddedBinaries {
+		fmt.Printf("+ %s\n", path)
+	}
+	for _, path := range diff.RemovedBinaries {
+		fmt.Printf("- %s\n", path)
+	}
+	for _, bd := range diff.Changed {
+		fmt.Printf("~ %s\n", bd.Path)
+		for _, k := range bd.Added {
+			fmt.Printf("  + %s\n", k)
+		}
+		for _, k := range bd.Removed {
+			fmt.Printf("  - %s\n", k)
+		}
+		for _, k := range sortedKeys(bd.Changed) {
+			c := bd.Changed[k]
+			fmt.Printf("  ~ %s: %s => %s\n", k, ent.FormatValue(c.Old), ent.FormatValue(c.New))
+		}
+	}
+}
+
+// filterEmptyBinaryDiffs drops entries left with nothing to show after
+// --only-added/--only-removed filtering zeroed out their Added or Removed
+// side.
+func filterEmptyBinaryDiffs(diffs []*BinaryDiff) []*BinaryDiff {
+	out := diffs[:0]
+	for _, bd := range diffs {
+		if len(bd.Added) > 0 || len(bd.Removed) > 0 || len(bd.Changed) > 0 {
+			out = append(out, bd)
+		}
+	}
+	return out
+}
+
+func sortedKeys(m map[string]ValueChange) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
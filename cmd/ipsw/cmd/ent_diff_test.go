@@ -0,0 +1,75 @@
+package cmd
+
+import "testing"
+
+func TestDiffEnts(t *testing.T) {
+	oldEnts := map[string]string{
+		"/usr/libexec/unchanged": "<plist>same</plist>",
+		"/usr/libexec/changed":   "<dict><key>com.apple.foo</key><true/></dict>",
+		"/usr/libexec/removed":   "<plist>gone</plist>",
+	}
+	newEnts := map[string]string{
+		"/usr/libexec/unchanged": "<plist>same</plist>",
+		"/usr/libexec/changed":   "<dict><key>com.apple.foo</key><false/><key>com.apple.bar</key><true/></dict>",
+		"/usr/libexec/added":     "<plist>new</plist>",
+	}
+
+	diff, err := diffEnts(oldEnts, newEnts, false)
+	if err != nil {
+		t.Fatalf("diffEnts() error = %v", err)
+	}
+
+	if len(diff.AddedBinaries) != 1 || diff.AddedBinaries[0] != "/usr/libexec/added" {
+		t.Errorf("AddedBinaries = %v, want [/usr/libexec/added]", diff.AddedBinaries)
+	}
+	if len(diff.RemovedBinaries) != 1 || diff.RemovedBinaries[0] != "/usr/libexec/removed" {
+		t.Errorf("RemovedBinaries = %v, want [/usr/libexec/removed]", diff.RemovedBinaries)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].Path != "/usr/libexec/changed" {
+		t.Fatalf("Changed = %v, want a single entry for /usr/libexec/changed", diff.Changed)
+	}
+
+	bd := diff.Changed[0]
+	if len(bd.Added) != 1 || bd.Added[0] != "com.apple.bar" {
+		t.Errorf("Changed[0].Added = %v, want [com.apple.bar]", bd.Added)
+	}
+	if len(bd.Removed) != 0 {
+		t.Errorf("Changed[0].Removed = %v, want none", bd.Removed)
+	}
+	if _, ok := bd.Changed["com.apple.foo"]; !ok {
+		t.Errorf("Changed[0].Changed = %v, want com.apple.foo present", bd.Changed)
+	}
+}
+
+func TestDiffEntsKeysOnly(t *testing.T) {
+	oldEnts := map[string]string{
+		"/usr/libexec/changed": "<dict><key>com.apple.foo</key><true/></dict>",
+	}
+	newEnts := map[string]string{
+		"/usr/libexec/changed": "<dict><key>com.apple.foo</key><false/></dict>",
+	}
+
+	diff, err := diffEnts(oldEnts, newEnts, true)
+	if err != nil {
+		t.Fatalf("diffEnts() error = %v", err)
+	}
+	if len(diff.Changed) != 0 {
+		t.Errorf("Changed = %v, want none when a value-only change is ignored under --keys-only", diff.Changed)
+	}
+}
+
+func TestFilterEmptyBinaryDiffs(t *testing.T) {
+	diffs := []*BinaryDiff{
+		{Path: "/usr/libexec/a", Added: []string{"com.apple.foo"}},
+		{Path: "/usr/libexec/b"},
+		{Path: "/usr/libexec/c", Removed: []string{"com.apple.bar"}},
+	}
+
+	got := filterEmptyBinaryDiffs(diffs)
+	if len(got) != 2 {
+		t.Fatalf("filterEmptyBinaryDiffs() = %v, want 2 entries", got)
+	}
+	if got[0].Path != "/usr/libexec/a" || got[1].Path != "/usr/libexec/c" {
+		t.Errorf("filterEmptyBinaryDiffs() = %v, want a and c (b has nothing left to show)", got)
+	}
+}
@@ -0,0 +1,265 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package db implements a content-addressable, incrementally-updatable
+// store for MachO entitlements, modeled on buildkit's cache/contenthash
+// package: every entitlements plist is stored once as a blob keyed by its
+// sha256 digest, and a small manifest maps each cleaned absolute path to
+// that digest. Paths are additionally indexed in memory by an immutable
+// radix tree so prefix lookups (e.g. "everything under /usr/libexec") walk
+// only the matching subtree instead of a full map scan. Glob patterns are
+// not indexed; matching one means walking every entry.
+package db
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	iradix "github.com/hashicorp/go-immutable-radix"
+)
+
+const manifestName = "manifest.json"
+
+// Entry is a single leaf in the entitlements store.
+type Entry struct {
+	// Digest is the sha256 of the raw entitlements plist bytes; "" means the
+	// binary has no entitlements.
+	Digest string `json:"digest,omitempty"`
+}
+
+// Manifest is the on-disk index of a DB: a digest of its entries, the
+// sha256 of each source DMG it was last scanned from (keyed by dmg type,
+// e.g. "SystemOS"), and the path->Entry map. It is small enough to load
+// eagerly; the plist blobs it references are loaded lazily from the blob
+// pack.
+type Manifest struct {
+	Digest  string            `json:"digest"`
+	Sources map[string]string `json:"sources,omitempty"`
+	Entries map[string]Entry  `json:"entries"`
+}
+
+// digest hashes the manifest's entries so Manifest.Digest can be recomputed
+// deterministically regardless of map iteration order.
+func (m *Manifest) digest() string {
+	paths := make([]string, 0, len(m.Entries))
+	for p := range m.Entries {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	h := sha256.New()
+	for _, p := range paths {
+		e := m.Entries[p]
+		fmt.Fprintf(h, "%s\x00%s\x00", p, e.Digest)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// DB is an entitlements store rooted at dir, containing a manifest.json and
+// a content-addressed blobs/ pack.
+type DB struct {
+	dir      string
+	manifest Manifest
+	tree     *iradix.Tree
+}
+
+// Open loads the DB rooted at dir, creating an empty one if dir doesn't yet
+// contain a manifest.
+func Open(dir string) (*DB, error) {
+	d := &DB{dir: dir, tree: iradix.New()}
+
+	mf, err := os.Open(filepath.Join(dir, manifestName))
+	if os.IsNotExist(err) {
+		return d, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to open manifest: %v", err)
+	}
+	defer mf.Close()
+
+	if err := json.NewDecoder(mf).Decode(&d.manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest: %v", err)
+	}
+	if d.manifest.Entries == nil {
+		d.manifest.Entries = make(map[string]Entry)
+	}
+
+	txn := d.tree.Txn()
+	for p, e := range d.manifest.Entries {
+		txn.Insert([]byte(filepath.Clean(p)), e)
+	}
+	d.tree = txn.Commit()
+
+	return d, nil
+}
+
+// Len returns the number of paths indexed in the DB.
+func (d *DB) Len() int {
+	return len(d.manifest.Entries)
+}
+
+// Digest returns the manifest's entries digest as of the last Save (or as
+// loaded by Open), or "" if the DB has never been saved. Two DBs with
+// equal, non-empty digests held identical entries when last saved.
+func (d *DB) Digest() string {
+	return d.manifest.Digest
+}
+
+// SourceDigest returns the sha256 of the raw DMG last scanned to produce
+// dmgType's entries in this DB, and whether one was recorded.
+func (d *DB) SourceDigest(dmgType string) (string, bool) {
+	digest, ok := d.manifest.Sources[dmgType]
+	return digest, ok
+}
+
+// SetSourceDigest records the sha256 of the raw DMG that dmgType's entries
+// were scanned from, so a later call to SourceDigest can detect an
+// unchanged DMG and skip re-scanning it.
+func (d *DB) SetSourceDigest(dmgType, digest string) {
+	if d.manifest.Sources == nil {
+		d.manifest.Sources = make(map[string]string)
+	}
+	d.manifest.Sources[dmgType] = digest
+}
+
+// Put stores the entitlements plist for path, deduplicating identical
+// blobs by content, and indexes path in the radix tree.
+func (d *DB) Put(path string, plist []byte) error {
+	path = filepath.Clean(path)
+
+	var e Entry
+	if len(plist) > 0 {
+		sum := sha256.Sum256(plist)
+		e.Digest = hex.EncodeToString(sum[:])
+		if err := d.writeBlob(e.Digest, plist); err != nil {
+			return err
+		}
+	}
+
+	if d.manifest.Entries == nil {
+		d.manifest.Entries = make(map[string]Entry)
+	}
+	d.manifest.Entries[path] = e
+
+	txn := d.tree.Txn()
+	txn.Insert([]byte(path), e)
+	d.tree = txn.Commit()
+
+	return nil
+}
+
+// Get returns the raw entitlements plist bytes stored for path.
+func (d *DB) Get(path string) ([]byte, bool, error) {
+	v, ok := d.tree.Get([]byte(filepath.Clean(path)))
+	if !ok {
+		return nil, false, nil
+	}
+	e := v.(Entry)
+	if len(e.Digest) == 0 {
+		return nil, true, nil // known path, no entitlements
+	}
+	plist, err := d.readBlob(e.Digest)
+	return plist, true, err
+}
+
+// WalkPrefix calls fn for every path in the DB with the given prefix,
+// passing its raw plist bytes. Iteration stops early if fn returns
+// false.
+func (d *DB) WalkPrefix(prefix string, fn func(path string, plist []byte) bool) error {
+	var walkErr error
+	d.tree.Root().WalkPrefix([]byte(filepath.Clean(prefix)), func(k []byte, v interface{}) bool {
+		e := v.(Entry)
+		var plist []byte
+		if len(e.Digest) > 0 {
+			var err error
+			if plist, err = d.readBlob(e.Digest); err != nil {
+				walkErr = err
+				return true
+			}
+		}
+		return !fn(string(k), plist)
+	})
+	return walkErr
+}
+
+// Merge unions other's manifest into d, with other's entries winning on
+// path collisions. Blobs are content-addressed, so shared binaries between
+// the two DBs are copied at most once.
+func (d *DB) Merge(other *DB) error {
+	for p, e := range other.manifest.Entries {
+		var plist []byte
+		if len(e.Digest) > 0 {
+			var err error
+			if plist, err = other.readBlob(e.Digest); err != nil {
+				return err
+			}
+		}
+		if err := d.Put(p, plist); err != nil {
+			return fmt.Errorf("failed to merge %s: %v", p, err)
+		}
+	}
+	for dmgType, digest := range other.manifest.Sources {
+		d.SetSourceDigest(dmgType, digest)
+	}
+	return nil
+}
+
+// Save recomputes the manifest digest and flushes it to dir/manifest.json.
+func (d *DB) Save() error {
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create db dir %s: %v", d.dir, err)
+	}
+	d.manifest.Digest = d.manifest.digest()
+
+	buf := new(bytes.Buffer)
+	if err := json.NewEncoder(buf).Encode(d.manifest); err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	return os.WriteFile(filepath.Join(d.dir, manifestName), buf.Bytes(), 0o644)
+}
+
+func (d *DB) blobPath(digest string) string {
+	return filepath.Join(d.dir, "blobs", digest[:2], digest[2:])
+}
+
+func (d *DB) writeBlob(digest string, data []byte) error {
+	p := d.blobPath(digest)
+	if _, err := os.Stat(p); err == nil {
+		return nil // already have this blob (content-addressed, so it's identical)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return fmt.Errorf("failed to create blob dir: %v", err)
+	}
+	return os.WriteFile(p, data, 0o644)
+}
+
+func (d *DB) readBlob(digest string) ([]byte, error) {
+	data, err := os.ReadFile(d.blobPath(digest))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read blob %s: %v", digest, err)
+	}
+	return data, nil
+}
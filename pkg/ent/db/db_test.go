@@ -0,0 +1,158 @@
+package db
+
+import "testing"
+
+func TestDBPutGet(t *testing.T) {
+	d, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	if err := d.Put("/usr/libexec/signed", []byte("<plist>ent-a</plist>")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	if err := d.Put("/usr/libexec/unsigned", nil); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+
+	plist, ok, err := d.Get("/usr/libexec/signed")
+	if err != nil || !ok || string(plist) != "<plist>ent-a</plist>" {
+		t.Errorf("Get(signed) = %q, %v, %v, want <plist>ent-a</plist>, true, nil", plist, ok, err)
+	}
+	plist, ok, err = d.Get("/usr/libexec/unsigned")
+	if err != nil || !ok || len(plist) != 0 {
+		t.Errorf("Get(unsigned) = %q, %v, %v, want \"\", true, nil", plist, ok, err)
+	}
+	if _, ok, err := d.Get("/usr/libexec/missing"); err != nil || ok {
+		t.Errorf("Get(missing) = _, %v, %v, want false, nil", ok, err)
+	}
+}
+
+func TestDBSaveOpenRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+
+	d, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	if err := d.Put("/usr/libexec/signed", []byte("<plist>ent-a</plist>")); err != nil {
+		t.Fatalf("Put() error = %v", err)
+	}
+	d.SetSourceDigest("SystemOS", "deadbeef")
+	if err := d.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	reopened, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open() (reopen) error = %v", err)
+	}
+	if reopened.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", reopened.Len())
+	}
+	plist, ok, err := reopened.Get("/usr/libexec/signed")
+	if err != nil || !ok || string(plist) != "<plist>ent-a</plist>" {
+		t.Errorf("Get(signed) after reopen = %q, %v, %v", plist, ok, err)
+	}
+	if digest, ok := reopened.SourceDigest("SystemOS"); !ok || digest != "deadbeef" {
+		t.Errorf("SourceDigest(SystemOS) = %q, %v, want deadbeef, true", digest, ok)
+	}
+	if reopened.Digest() == "" {
+		t.Error("Digest() = \"\", want a non-empty digest after Save")
+	}
+}
+
+func TestDBDigestDeterministic(t *testing.T) {
+	a, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	b, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	// Insert in opposite order: the manifest digest must not depend on
+	// map/insertion order.
+	a.Put("/a", []byte("one"))
+	a.Put("/b", []byte("two"))
+	b.Put("/b", []byte("two"))
+	b.Put("/a", []byte("one"))
+
+	if err := a.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if err := b.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	if a.Digest() != b.Digest() {
+		t.Errorf("Digest() mismatch for identical entries inserted in different orders: %s != %s", a.Digest(), b.Digest())
+	}
+
+	b.Put("/c", []byte("three"))
+	if err := b.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+	if a.Digest() == b.Digest() {
+		t.Error("Digest() should differ once b has an extra entry")
+	}
+}
+
+func TestDBWalkPrefix(t *testing.T) {
+	d, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	d.Put("/usr/libexec/a", []byte("ent-a"))
+	d.Put("/usr/libexec/b", []byte("ent-b"))
+	d.Put("/usr/bin/c", []byte("ent-c"))
+
+	got := make(map[string]string)
+	if err := d.WalkPrefix("/usr/libexec", func(path string, plist []byte) bool {
+		got[path] = string(plist)
+		return true
+	}); err != nil {
+		t.Fatalf("WalkPrefix() error = %v", err)
+	}
+	if len(got) != 2 || got["/usr/libexec/a"] != "ent-a" || got["/usr/libexec/b"] != "ent-b" {
+		t.Errorf("WalkPrefix(/usr/libexec) = %v, want entries a and b only", got)
+	}
+}
+
+func TestDBMerge(t *testing.T) {
+	a, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+	b, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	a.Put("/shared", []byte("old"))
+	a.Put("/only-a", []byte("a"))
+	b.Put("/shared", []byte("new"))
+	b.Put("/only-b", []byte("b"))
+	b.SetSourceDigest("SystemOS", "deadbeef")
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("Merge() error = %v", err)
+	}
+
+	if a.Len() != 3 {
+		t.Fatalf("Len() = %d, want 3", a.Len())
+	}
+	if plist, _, _ := a.Get("/shared"); string(plist) != "new" {
+		t.Errorf("Get(/shared) = %q, want \"new\" (other wins on collision)", plist)
+	}
+	if plist, _, _ := a.Get("/only-a"); string(plist) != "a" {
+		t.Errorf("Get(/only-a) = %q, want \"a\"", plist)
+	}
+	if plist, _, _ := a.Get("/only-b"); string(plist) != "b" {
+		t.Errorf("Get(/only-b) = %q, want \"b\"", plist)
+	}
+	if digest, ok := a.SourceDigest("SystemOS"); !ok || digest != "deadbeef" {
+		t.Errorf("SourceDigest(SystemOS) = %q, %v, want deadbeef, true", digest, ok)
+	}
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package db
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"os"
+)
+
+// MigrateGob reads a legacy gzipped-gob ".entDB" file (a flat
+// map[string]string of path -> raw entitlements plist) and imports every
+// entry into d, persisting the result. It's a one-time upgrade path so
+// users don't lose an existing entitlement database when they pick up the
+// new store.
+func MigrateGob(d *DB, gobPath string) error {
+	legacy, err := DecodeGob(gobPath)
+	if err != nil {
+		return err
+	}
+
+	for path, plist := range legacy {
+		if err := d.Put(path, []byte(plist)); err != nil {
+			return fmt.Errorf("failed to migrate %s: %v", path, err)
+		}
+	}
+
+	return d.Save()
+}
+
+// DecodeGob reads a legacy gzipped-gob ".entDB" file into a flat
+// path -> raw entitlements plist map without writing anything to disk. Use
+// this (rather than MigrateGob) when a legacy database only needs to be
+// read, not upgraded in place.
+func DecodeGob(gobPath string) (map[string]string, error) {
+	f, err := os.Open(gobPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open legacy entitlement database %s: %v", gobPath, err)
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gzip reader: %v", err)
+	}
+	defer gzr.Close()
+
+	legacy := make(map[string]string)
+	if err := gob.NewDecoder(gzr).Decode(&legacy); err != nil {
+		return nil, fmt.Errorf("failed to decode legacy entitlement database: %v", err)
+	}
+
+	return legacy, nil
+}
@@ -0,0 +1,158 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package ent contains types and helpers for decoding, formatting and
+// querying MachO code-signing entitlements extracted from IPSW filesystem
+// images.
+package ent
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/blacktop/go-plist"
+)
+
+// Entitlements is a decoded entitlements property list.
+type Entitlements map[string]interface{}
+
+// Decode parses a raw entitlements plist (as stored in a MachO's code
+// signature blob) into an Entitlements map.
+func Decode(plistData string) (Entitlements, error) {
+	if len(plistData) == 0 {
+		return Entitlements{}, nil
+	}
+	ents := make(Entitlements)
+	if err := plist.NewDecoder(bytes.NewReader([]byte(plistData))).Decode(&ents); err != nil {
+		return nil, fmt.Errorf("failed to decode entitlements plist: %v", err)
+	}
+	return ents, nil
+}
+
+// Keys returns the entitlement's top-level keys sorted alphabetically.
+func (e Entitlements) Keys() []string {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// FormatValue renders an entitlement value (bool, string, number, array or
+// dict) as a single-line human readable string suitable for tabwriter
+// output.
+func FormatValue(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return fmt.Sprintf("%t", val)
+	case string:
+		return val
+	case []interface{}:
+		items := make([]string, len(val))
+		for i, item := range val {
+			items[i] = FormatValue(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case map[string]interface{}:
+		return formatDict(val)
+	case Entitlements:
+		return formatDict(val)
+	default:
+		return fmt.Sprintf("%v", val)
+	}
+}
+
+func formatDict(m map[string]interface{}) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = fmt.Sprintf("%s: %s", k, FormatValue(m[k]))
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// Fprint writes a tabwriter row for every key in ents whose name contains
+// entitlement, formatting values of any plist kind (bool, string, number,
+// array or dict). Keys whose value is the bool false are skipped.
+func Fprint(w *tabwriter.Writer, file string, ents Entitlements, entitlement string) {
+	for _, k := range ents.Keys() {
+		if !strings.Contains(k, entitlement) {
+			continue
+		}
+		if b, ok := ents[k].(bool); ok && !b {
+			continue // preserve legacy behavior of skipping `false` bool entitlements
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", k, FormatValue(ents[k]), file)
+	}
+}
+
+// Fscan decodes the entitlements blob for path and writes any matching rows
+// to w. An empty plistData is treated as "no entitlements" and never
+// matches.
+func Fscan(w *tabwriter.Writer, path, plistData, entitlement string) error {
+	if len(plistData) == 0 {
+		return nil
+	}
+	ents, err := Decode(plistData)
+	if err != nil {
+		return fmt.Errorf("failed to decode entitlements for %s: %v", path, err)
+	}
+	Fprint(w, path, ents, entitlement)
+	return nil
+}
+
+// FprintQuery evaluates query against the entitlements decoded from
+// plistData and writes one tabwriter row per match to w. Callers scanning
+// many files should share one *tabwriter.Writer across the walk (as Fprint
+// does) and flush it once at the end so columns stay aligned across files.
+func FprintQuery(w *tabwriter.Writer, path, plistData string, query *Query) error {
+	if len(plistData) == 0 {
+		return nil
+	}
+	ents, err := Decode(plistData)
+	if err != nil {
+		return fmt.Errorf("failed to decode entitlements for %s: %v", path, err)
+	}
+	matches := query.Match(ents)
+	if len(matches) == 0 {
+		return nil
+	}
+	paths := make([]string, 0, len(matches))
+	for p := range matches {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", p, FormatValue(matches[p]), path)
+	}
+	return nil
+}
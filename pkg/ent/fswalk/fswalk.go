@@ -0,0 +1,68 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+
+// Package fswalk abstracts how the ent command walks a DMG's filesystem
+// looking for MachOs, behind an afero.Fs, so scans can be driven in tests
+// with an in-memory fixture filesystem instead of a real mounted DMG.
+package fswalk
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/blacktop/ipsw/internal/utils"
+	"github.com/spf13/afero"
+)
+
+// Backend opens dmgPath as an afero.Fs rooted at the DMG's filesystem root,
+// returning a cleanup func that releases whatever mount/handle it took to
+// do so.
+type Backend func(dmgPath string) (afero.Fs, func() error, error)
+
+// Mounted is the default Backend: it mounts the DMG (hdiutil on macOS,
+// apfs-fuse/root on Linux) via utils.MountFS and exposes the mount point as
+// a base-path afero.Fs over the host filesystem.
+func Mounted(dmgPath string) (afero.Fs, func() error, error) {
+	mountPoint, err := utils.MountFS(dmgPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to mount DMG: %v", err)
+	}
+	cleanup := func() error {
+		return utils.Unmount(mountPoint, false)
+	}
+	return afero.NewBasePathFs(afero.NewOsFs(), mountPoint), cleanup, nil
+}
+
+// Walk calls fn with the path of every non-directory entry reachable from root in
+// fsys, via a standard directory walk (works for Mounted and for the
+// afero.NewMemMapFs fixtures used in tests).
+func Walk(fsys afero.Fs, root string, fn func(path string) error) error {
+	return afero.Walk(fsys, root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return fn(path)
+	})
+}
@@ -0,0 +1,132 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package fswalk
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// ScanParallel is Scan restructured around a bounded worker pool: the
+// filesystem is walked once up front to build the file list, then jobs
+// workers pull paths off a channel, open and extract each one concurrently,
+// and a single collector goroutine folds the results into the returned map.
+//
+// progress, if non-nil, is called once per file after it has been opened
+// and extracted (whether or not it turned out to be a MachO), so callers
+// can drive a progress bar sized to the pre-counted file list. The first
+// error opening a file aborts the remaining work via ctx and is returned;
+// extraction errors (a file just isn't a MachO) are skipped as in Scan.
+func ScanParallel(ctx context.Context, fsys afero.Fs, root string, jobs int, extract Extractor, progress func()) (map[string]string, error) {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	var paths []string
+	if err := Walk(fsys, root, func(path string) error {
+		paths = append(paths, path)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		path  string
+		plist string
+	}
+
+	pathCh := make(chan string)
+	resultCh := make(chan result)
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	for w := 0; w < jobs; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for path := range pathCh {
+				f, err := fsys.Open(path)
+				if err != nil {
+					fail(fmt.Errorf("failed to open %s: %v", path, err))
+					return
+				}
+				plist, extractErr := extract(f)
+				f.Close()
+
+				if progress != nil {
+					progress()
+				}
+				if extractErr != nil {
+					continue // not a MachO (or unreadable) - skip, as before
+				}
+
+				select {
+				case resultCh <- result{path: path, plist: plist}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	go func() {
+		defer close(pathCh)
+		for _, p := range paths {
+			select {
+			case pathCh <- p:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	ents := make(map[string]string, len(paths))
+	for r := range resultCh {
+		ents[r.path] = r.plist
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return ents, nil
+}
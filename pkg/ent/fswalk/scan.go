@@ -0,0 +1,43 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package fswalk
+
+import (
+	"context"
+
+	"github.com/spf13/afero"
+)
+
+// Extractor pulls the raw entitlements plist (or "" for none) out of a
+// single opened file. In production this opens the file as a MachO and
+// reads its code signature; tests substitute a fixture extractor so the
+// walk/collect pipeline can be exercised without real MachO binaries.
+type Extractor func(afero.File) (string, error)
+
+// Scan walks every non-directory entry reachable from root in fsys and calls
+// extract on each, collecting path -> entitlements plist. A file extract
+// errors on (e.g. it isn't a MachO) is skipped rather than failing the
+// whole scan, matching the original macho.Open-failure handling. It scans
+// on a single goroutine; see ScanParallel for large volumes.
+func Scan(fsys afero.Fs, root string, extract Extractor) (map[string]string, error) {
+	return ScanParallel(context.Background(), fsys, root, 1, extract, nil)
+}
@@ -0,0 +1,65 @@
+package fswalk
+
+import (
+	"testing"
+
+	entdb "github.com/blacktop/ipsw/pkg/ent/db"
+	"github.com/spf13/afero"
+)
+
+// TestScanIntoDB exercises the full path a real ent scan takes: walk a
+// filesystem, extract entitlements, and persist the results into a
+// content-addressable DB, then reopen it and confirm the round trip.
+func TestScanIntoDB(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+
+	files := map[string]string{
+		"/usr/libexec/signed":   "MACHO:<plist>ent-a</plist>",
+		"/usr/libexec/unsigned": "MACHO:",
+		"/usr/libexec/readme":   "not a macho at all",
+	}
+	for path, content := range files {
+		if err := afero.WriteFile(fsys, path, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write fixture %s: %v", path, err)
+		}
+	}
+
+	ents, err := Scan(fsys, "/", fixtureExtractor)
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+
+	dir := t.TempDir()
+	d, err := entdb.Open(dir)
+	if err != nil {
+		t.Fatalf("entdb.Open() error = %v", err)
+	}
+	for path, plist := range ents {
+		if err := d.Put(path, []byte(plist)); err != nil {
+			t.Fatalf("Put(%s) error = %v", path, err)
+		}
+	}
+	if err := d.Save(); err != nil {
+		t.Fatalf("Save() error = %v", err)
+	}
+
+	reopened, err := entdb.Open(dir)
+	if err != nil {
+		t.Fatalf("entdb.Open() (reopen) error = %v", err)
+	}
+	if reopened.Len() != len(ents) {
+		t.Fatalf("Len() = %d, want %d", reopened.Len(), len(ents))
+	}
+
+	plist, ok, err := reopened.Get("/usr/libexec/signed")
+	if err != nil || !ok || string(plist) != "<plist>ent-a</plist>" {
+		t.Errorf("Get(signed) = %q, %v, %v, want <plist>ent-a</plist>, true, nil", plist, ok, err)
+	}
+	plist, ok, err = reopened.Get("/usr/libexec/unsigned")
+	if err != nil || !ok || len(plist) != 0 {
+		t.Errorf("Get(unsigned) = %q, %v, %v, want \"\", true, nil", plist, ok, err)
+	}
+	if _, ok, _ := reopened.Get("/usr/libexec/readme"); ok {
+		t.Errorf("non-macho file %q should never have reached the DB", "/usr/libexec/readme")
+	}
+}
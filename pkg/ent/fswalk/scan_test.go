@@ -0,0 +1,89 @@
+package fswalk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// fixtureExtractor stands in for macho.NewFile in tests: any file whose
+// contents start with "MACHO:" is treated as a MachO with the rest of the
+// content as its entitlements plist, everything else fails to "parse" the
+// same way a non-MachO file fails macho.Open.
+func fixtureExtractor(f afero.File) (string, error) {
+	data := make([]byte, 6)
+	if _, err := f.Read(data); err != nil || string(data) != "MACHO:" {
+		return "", errors.New("not a macho")
+	}
+	rest, _ := afero.ReadAll(f)
+	return string(rest), nil
+}
+
+func TestScan(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+
+	files := map[string]string{
+		"/usr/libexec/signed":   "MACHO:<plist>ent-a</plist>",
+		"/usr/libexec/unsigned": "MACHO:",
+		"/usr/libexec/readme":   "not a macho at all",
+	}
+	for path, content := range files {
+		if err := afero.WriteFile(fsys, path, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write fixture %s: %v", path, err)
+		}
+	}
+
+	ents, err := Scan(fsys, "/", fixtureExtractor)
+	if err != nil {
+		t.Fatalf("Scan() error = %v", err)
+	}
+
+	if len(ents) != 2 {
+		t.Fatalf("expected 2 macho entries, got %d: %v", len(ents), ents)
+	}
+	if got := ents["/usr/libexec/signed"]; got != "<plist>ent-a</plist>" {
+		t.Errorf("signed entitlements = %q, want %q", got, "<plist>ent-a</plist>")
+	}
+	if got, ok := ents["/usr/libexec/unsigned"]; !ok || got != "" {
+		t.Errorf("unsigned entitlements = %q, %v, want \"\", true", got, ok)
+	}
+	if _, ok := ents["/usr/libexec/readme"]; ok {
+		t.Errorf("non-macho file %q should not appear in results", "/usr/libexec/readme")
+	}
+}
+
+func TestScanParallel(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+
+	const total = 20
+	wantMachOs := 0
+	for i := 0; i < total; i++ {
+		path := fmt.Sprintf("/usr/libexec/bin%d", i)
+		content := "not a macho"
+		if i%2 == 0 {
+			content = fmt.Sprintf("MACHO:<plist>ent-%d</plist>", i)
+			wantMachOs++
+		}
+		if err := afero.WriteFile(fsys, path, []byte(content), 0o644); err != nil {
+			t.Fatalf("failed to write fixture %s: %v", path, err)
+		}
+	}
+
+	var progressed int32
+	ents, err := ScanParallel(context.Background(), fsys, "/", 4, fixtureExtractor, func() {
+		atomic.AddInt32(&progressed, 1)
+	})
+	if err != nil {
+		t.Fatalf("ScanParallel() error = %v", err)
+	}
+	if len(ents) != wantMachOs {
+		t.Fatalf("expected %d macho entries, got %d", wantMachOs, len(ents))
+	}
+	if int(progressed) != total {
+		t.Fatalf("expected %d progress callbacks (one per file), got %d", total, progressed)
+	}
+}
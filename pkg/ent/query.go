@@ -0,0 +1,155 @@
+/*
+Copyright © 2018-2022 blacktop
+
+Permission is hereby granted, free of charge, to any person obtaining a copy
+of this software and associated documentation files (the "Software"), to deal
+in the Software without restriction, including without limitation the rights
+to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+copies of the Software, and to permit persons to whom the Software is
+furnished to do so, subject to the following conditions:
+
+The above copyright notice and this permission notice shall be included in
+all copies or substantial portions of the Software.
+
+THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+THE SOFTWARE.
+*/
+package ent
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Op is the comparison a Query applies to the value found at its Path.
+type Op int
+
+const (
+	// OpExists matches any key reached by Path, regardless of value.
+	OpExists Op = iota
+	// OpEquals matches when the value stringifies to exactly Value.
+	OpEquals
+	// OpRegex matches when Value, compiled as a regexp, matches the
+	// stringified value.
+	OpRegex
+)
+
+// Query is a small expression for selecting entitlement keys/values out of
+// an entitlements plist, e.g.:
+//
+//	com.apple.security.get-task-allow
+//	com.apple.private.security.storage.*==allow
+//	keychain-access-groups[*]~=^com\.apple\.
+//
+// Entitlement keys are flat dotted strings (the dot is part of the key,
+// not a nesting separator), so Path is matched whole, with filepath.Match
+// glob semantics, against each top-level key. A Path suffixed with "[*]"
+// walks every element of the array found at that key instead of matching
+// the key's value directly. To descend into an entitlement whose value is
+// itself a dict, separate levels with "/", e.g. "com.apple.foo/teamID".
+type Query struct {
+	Path  string
+	Op    Op
+	Value string
+}
+
+// ParseQuery parses a --query expression into a Query. A bare path with no
+// operator matches any key reached by that path (OpExists).
+func ParseQuery(expr string) (*Query, error) {
+	expr = strings.TrimSpace(expr)
+	if len(expr) == 0 {
+		return nil, fmt.Errorf("empty query expression")
+	}
+	if idx := strings.Index(expr, "~="); idx >= 0 {
+		return &Query{Path: expr[:idx], Op: OpRegex, Value: expr[idx+2:]}, nil
+	}
+	if idx := strings.Index(expr, "=="); idx >= 0 {
+		return &Query{Path: expr[:idx], Op: OpEquals, Value: expr[idx+2:]}, nil
+	}
+	return &Query{Path: expr, Op: OpExists}, nil
+}
+
+// Match walks ents following q.Path and returns every matching leaf, keyed
+// by the path (with [n] array indices, and "/" between dict levels) at
+// which it was found.
+func (q *Query) Match(ents Entitlements) map[string]interface{} {
+	matches := make(map[string]interface{})
+	q.walk("", ents, strings.Split(q.Path, "/"), matches)
+	return matches
+}
+
+func (q *Query) walk(prefix string, node interface{}, segments []string, out map[string]interface{}) {
+	if len(segments) == 0 {
+		if q.matchValue(node) {
+			out[prefix] = node
+		}
+		return
+	}
+
+	seg := segments[0]
+	rest := segments[1:]
+	arrayWildcard := strings.HasSuffix(seg, "[*]")
+	key := strings.TrimSuffix(seg, "[*]")
+
+	m, ok := asDict(node)
+	if !ok {
+		return
+	}
+
+	for k, v := range m {
+		matched, err := filepath.Match(key, k)
+		if err != nil || !matched {
+			continue
+		}
+		path := k
+		if prefix != "" {
+			path = prefix + "/" + k
+		}
+		if arrayWildcard {
+			arr, ok := v.([]interface{})
+			if !ok {
+				continue
+			}
+			for i, item := range arr {
+				q.walk(fmt.Sprintf("%s[%d]", path, i), item, rest, out)
+			}
+		} else {
+			q.walk(path, v, rest, out)
+		}
+	}
+}
+
+func asDict(node interface{}) (map[string]interface{}, bool) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		return v, true
+	case Entitlements:
+		return v, true
+	default:
+		return nil, false
+	}
+}
+
+func (q *Query) matchValue(v interface{}) bool {
+	switch q.Op {
+	case OpExists:
+		return true
+	case OpEquals:
+		return FormatValue(v) == q.Value
+	case OpRegex:
+		re, err := regexp.Compile(q.Value)
+		if err != nil {
+			return false
+		}
+		return re.MatchString(FormatValue(v))
+	default:
+		return false
+	}
+}
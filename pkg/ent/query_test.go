@@ -0,0 +1,117 @@
+package ent
+
+import "testing"
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    Query
+		wantErr bool
+	}{
+		{expr: "com.apple.security.get-task-allow", want: Query{Path: "com.apple.security.get-task-allow", Op: OpExists}},
+		{expr: "com.apple.private.security.storage.*==allow", want: Query{Path: "com.apple.private.security.storage.*", Op: OpEquals, Value: "allow"}},
+		{expr: "keychain-access-groups[*]~=^com\\.apple\\.", want: Query{Path: "keychain-access-groups[*]", Op: OpRegex, Value: "^com\\.apple\\."}},
+		{expr: "  foo  ", want: Query{Path: "foo", Op: OpExists}},
+		{expr: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseQuery(tt.expr)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseQuery(%q) expected an error, got nil", tt.expr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseQuery(%q) unexpected error: %v", tt.expr, err)
+			continue
+		}
+		if *got != tt.want {
+			t.Errorf("ParseQuery(%q) = %+v, want %+v", tt.expr, *got, tt.want)
+		}
+	}
+}
+
+func TestQueryMatchExists(t *testing.T) {
+	ents := Entitlements{
+		"com.apple.security.get-task-allow": true,
+		"com.apple.application-identifier":  "ABCDE12345.com.example.app",
+	}
+
+	q, err := ParseQuery("com.apple.security.get-task-allow")
+	if err != nil {
+		t.Fatalf("ParseQuery() error = %v", err)
+	}
+	matches := q.Match(ents)
+	if v, ok := matches["com.apple.security.get-task-allow"]; !ok || v != true {
+		t.Errorf("matches = %v, want a match on com.apple.security.get-task-allow", matches)
+	}
+}
+
+func TestQueryMatchGlobKey(t *testing.T) {
+	ents := Entitlements{
+		"com.apple.private.security.storage.foo": "allow",
+		"com.apple.private.security.storage.bar": "deny",
+		"com.apple.other":                        "allow",
+	}
+
+	q, err := ParseQuery("com.apple.private.security.storage.*==allow")
+	if err != nil {
+		t.Fatalf("ParseQuery() error = %v", err)
+	}
+	matches := q.Match(ents)
+	if len(matches) != 1 {
+		t.Fatalf("matches = %v, want exactly 1", matches)
+	}
+	if _, ok := matches["com.apple.private.security.storage.foo"]; !ok {
+		t.Errorf("matches = %v, want a match on the .foo key only", matches)
+	}
+}
+
+func TestQueryMatchArrayWildcard(t *testing.T) {
+	ents := Entitlements{
+		"keychain-access-groups": []interface{}{"com.apple.token", "com.example.other"},
+	}
+
+	q, err := ParseQuery(`keychain-access-groups[*]~=^com\.apple\.`)
+	if err != nil {
+		t.Fatalf("ParseQuery() error = %v", err)
+	}
+	matches := q.Match(ents)
+	if len(matches) != 1 {
+		t.Fatalf("matches = %v, want exactly 1", matches)
+	}
+	if v, ok := matches["keychain-access-groups[0]"]; !ok || v != "com.apple.token" {
+		t.Errorf("matches = %v, want keychain-access-groups[0] = com.apple.token", matches)
+	}
+}
+
+func TestQueryMatchNestedDict(t *testing.T) {
+	ents := Entitlements{
+		"com.apple.developer.icloud-services": map[string]interface{}{
+			"teamID": "ABCDE12345",
+		},
+	}
+
+	q, err := ParseQuery("com.apple.developer.icloud-services/teamID==ABCDE12345")
+	if err != nil {
+		t.Fatalf("ParseQuery() error = %v", err)
+	}
+	matches := q.Match(ents)
+	if v, ok := matches["com.apple.developer.icloud-services/teamID"]; !ok || v != "ABCDE12345" {
+		t.Errorf("matches = %v, want a match on the nested teamID key", matches)
+	}
+}
+
+func TestQueryMatchNoMatch(t *testing.T) {
+	ents := Entitlements{"com.apple.foo": "bar"}
+
+	q, err := ParseQuery("com.apple.foo==baz")
+	if err != nil {
+		t.Fatalf("ParseQuery() error = %v", err)
+	}
+	if matches := q.Match(ents); len(matches) != 0 {
+		t.Errorf("matches = %v, want none", matches)
+	}
+}